@@ -0,0 +1,21 @@
+// consumer runs App.Consume outside of Lambda, e.g. as an ECS/Fargate task,
+// long-polling the work queue that the Lambda entrypoint enqueues onto.
+package main
+
+import (
+	"context"
+
+	"github.com/GSA/aws-terraform-executor/lambda/app"
+)
+
+func main() {
+	a, err := app.New()
+	if err != nil {
+		panic(err)
+	}
+
+	err = a.Consume(context.Background())
+	if err != nil {
+		panic(err)
+	}
+}
@@ -1,60 +1,90 @@
 package app
 
 import (
-	"bufio"
 	"context"
 	"encoding/json"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
-	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"runtime"
-	"strings"
 	"sync"
 
-	"github.com/aws/aws-lambda-go/lambdacontext"
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/caarlos0/env"
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
-	ghttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+
+	"github.com/GSA/aws-terraform-executor/lambda/blob"
 )
 
 // Config holds all variables read from the ENV
 type Config struct {
-	Region   string `env:"REGION" envDefault:"us-east-1"`
-	Bucket   string `env:"BUCKET"`
-	RepoURL  string `env:"REPO_URL"`
-	GitToken string `env:"GIT_TOKEN" envDefault:""`
-	RoleName string `env:"ROLE_NAME" envDefault:"OrganizationAccountAccessRole"`
+	Region           string `env:"REGION" envDefault:"us-east-1"`
+	StorageAddr      string `env:"STORAGE_ADDR"`
+	RepoURL          string `env:"REPO_URL"`
+	GitToken         string `env:"GIT_TOKEN" envDefault:""`
+	SSHKeyPath       string `env:"SSH_KEY_PATH" envDefault:""`
+	SSHKeyPassphrase string `env:"SSH_KEY_PASSPHRASE" envDefault:""`
+	SSHUser          string `env:"SSH_USER" envDefault:"git"`
+	KnownHostsPath   string `env:"KNOWN_HOSTS_PATH" envDefault:""`
+	RoleName         string `env:"ROLE_NAME" envDefault:"OrganizationAccountAccessRole"`
+	QueueURL         string `env:"QUEUE_URL"`
+	DLQURL           string `env:"DLQ_URL" envDefault:""`
+	MaxReceiveCount  int    `env:"MAX_RECEIVE_COUNT" envDefault:"5"`
+	RunInActions     bool   `env:"RUN_IN_ACTIONS" envDefault:"false"`
+	TFBinCache       string `env:"TF_BIN_CACHE" envDefault:""`
 }
 
 // Request is a struct that contains the request data.
 type Request struct {
-	ID        string                 `json:"id"`
-	Name      string                 `json:"name"`
-	Version   string                 `json:"version"`
-	LogLevel  string                 `json:"log_level"`
-	Variables map[string]interface{} `json:"variables"`
+	ID                 string                 `json:"id"`
+	Name               string                 `json:"name"`
+	Version            string                 `json:"version"`
+	LogLevel           string                 `json:"log_level"`
+	Variables          map[string]interface{} `json:"variables"`
+	SensitiveVariables []string               `json:"sensitive_variables"`
+	Mode               string                 `json:"mode"`
+	PlanKey            string                 `json:"plan_key"`
+	TerraformVersion   string                 `json:"terraform_version"`
+
+	// actions collects this request's GitHub Actions workflow commands so
+	// they can be flushed to stdout as a single atomic write. Unexported so
+	// it's never marshaled onto the queue.
+	actions *actionsBuffer
 }
 
+// Terraform command sequences a Request.Mode can drive.
+const (
+	ModePlan      = "plan"
+	ModeApply     = "apply"
+	ModeDestroy   = "destroy"
+	ModePlanApply = "plan-apply"
+)
+
 type App struct {
-	sess   *session.Session
-	bucket string
-	repo   string
-	token  string
-	role   string
-	tf     string
-	cpus   int
+	sess             *session.Session
+	storage          blob.Storage
+	sqs              *sqs.SQS
+	queueURL         string
+	dlqURL           string
+	maxReceiveCount  int
+	repo             string
+	token            string
+	sshKeyPath       string
+	sshKeyPassphrase string
+	sshUser          string
+	knownHosts       string
+	role             string
+	tfCache          *tfCache
+	tfMu             sync.Mutex
+	cpus             int
+	actionsMode      bool
+	stdoutMu         sync.Mutex
 }
 
 func New() (*App, error) {
@@ -70,101 +100,70 @@ func New() (*App, error) {
 		return nil, fmt.Errorf("failed to create AWS session: %w", err)
 	}
 
+	storage, err := blob.New(context.Background(), cfg.StorageAddr, sess)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage backend: %w", err)
+	}
+
+	tfc, err := newTFCache(cfg.TFBinCache, sess)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create terraform binary cache: %w", err)
+	}
+
 	return &App{
-		cpus:   runtime.NumCPU(),
-		bucket: cfg.Bucket,
-		token:  cfg.GitToken,
-		repo:   cfg.RepoURL,
-		role:   cfg.RoleName,
-		sess:   sess,
+		cpus:             runtime.NumCPU(),
+		storage:          storage,
+		tfCache:          tfc,
+		sqs:              sqs.New(sess),
+		queueURL:         cfg.QueueURL,
+		dlqURL:           cfg.DLQURL,
+		maxReceiveCount:  cfg.MaxReceiveCount,
+		token:            cfg.GitToken,
+		sshKeyPath:       cfg.SSHKeyPath,
+		sshKeyPassphrase: cfg.SSHKeyPassphrase,
+		sshUser:          cfg.SSHUser,
+		knownHosts:       cfg.KnownHostsPath,
+		repo:             cfg.RepoURL,
+		role:             cfg.RoleName,
+		sess:             sess,
+		actionsMode:      cfg.RunInActions,
 	}, nil
 }
 
+// Run enqueues each request onto the work queue for a Consumer to pick up,
+// rather than executing it in process.
 func (a *App) Run(ctx context.Context, requests []*Request) error {
-	end := len(requests)
-	if end > a.cpus {
-		// Execute no more than the number of CPUs
-		// Send the rest to a new Lambda invocation
-		end = a.cpus
-		err := a.dispatch(requests[a.cpus:])
+	for _, req := range requests {
+		err := a.enqueue(ctx, req)
 		if err != nil {
 			return err
 		}
 	}
 
-	err := a.prepTf()
-	if err != nil {
-		return err
-	}
-
-	var wg sync.WaitGroup
-	wg.Add(end)
-	for _, req := range requests[:end] {
-		req := req
-		go func(req *Request, wg *sync.WaitGroup) {
-			err := a.execute(req)
-			if err != nil {
-				log.Printf("failed to execute: %s -> %v\n", req.Name, err)
-			}
-			wg.Done()
-		}(req, &wg)
-	}
-
-	wg.Wait()
-
 	return nil
 }
 
-// dispatch passes all requests beyond the number of CPUs to a new Lambda invocation
-func (a *App) dispatch(requests []*Request) error {
-	b, err := json.Marshal(requests)
-	if err != nil {
-		return fmt.Errorf("error marshaling requests: %w", err)
+// execute runs terraform using the given request
+func (a *App) execute(req *Request) error {
+	if a.actionsMode {
+		req.actions = &actionsBuffer{}
+		req.actions.printf("::group::%s\n", req.Name)
+		defer a.flushActions(req)
 	}
 
-	l := lambda.New(a.sess)
-	_, err = l.Invoke(&lambda.InvokeInput{
-		FunctionName:   aws.String(lambdacontext.FunctionName),
-		InvocationType: aws.String(lambda.InvocationTypeEvent),
-		Payload:        b,
-	})
-	if err != nil {
-		return fmt.Errorf("failed to dispatch requests: %w", err)
-	}
-
-	return nil
-}
-
-func (a *App) prepTf() error {
-	var err error
-	a.tf, err = getTerraform("latest")
+	tf, err := a.resolveTerraform(req.TerraformVersion)
 	if err != nil {
 		return err
 	}
 
-	err = os.Chmod(a.tf, 0750) // #nosec
-	if err != nil {
-		return fmt.Errorf("failed to make terraform executable: %w", err)
-	}
-
-	return nil
-}
-
-// execute runs terraform using the given request
-func (a *App) execute(req *Request) error {
 	path := filepath.Join("/tmp", req.Name)
 
-	err := a.checkout(a.repo, path, req.Version)
+	err = a.checkout(a.repo, path, req.Version)
 	if err != nil {
 		return err
 	}
 
-	creds, err := a.sess.Config.Credentials.Get()
-	if err != nil {
-		return fmt.Errorf("failed to get AWS credentials: %w", err)
-	}
-
-	err = a.createBackend(creds, path, req.Name)
+	err = a.createBackend(path, req.Name)
 	if err != nil {
 		return err
 	}
@@ -175,6 +174,10 @@ func (a *App) execute(req *Request) error {
 		return err
 	}
 
+	if a.actionsMode {
+		a.maskSecrets(cred, req)
+	}
+
 	pluginDir := filepath.Join("/tmp", "terraform.d", "plugins")
 	err = os.MkdirAll(pluginDir, 0750)
 	if err != nil {
@@ -187,7 +190,7 @@ func (a *App) execute(req *Request) error {
 		return fmt.Errorf("failed to create .terraform/modules directory: %w", err)
 	}
 
-	err = a.getModules(filepath.Join(path, "main.tf"))
+	err = a.getModules(path)
 	if err != nil {
 		return err
 	}
@@ -200,35 +203,59 @@ func (a *App) execute(req *Request) error {
 	env = append(env, fmt.Sprintf("TF_LOG=%s", req.LogLevel))
 	env = append(env, fmt.Sprintf("HOME=%s", path))
 
-	err = a.createGitConfig(filepath.Join(path, ".git", "config"))
+	credEnv, err := a.credentialEnv(path)
 	if err != nil {
 		return err
 	}
+	env = append(env, credEnv...)
 
-	init, err := a.runTf(path, req, env, "init", "-input=false", "-no-color")
-	if err != nil {
-		return err
-	}
-	err = init.Wait()
-	if err != nil {
+	if err := a.runTf(tf, path, req, env, "init", "-input=false", "-no-color", "-json"); err != nil {
 		return err
 	}
 
-	apply, err := a.runTf(path, req, env, "apply", "-input=false", "-auto-approve", "-no-color")
-	if err != nil {
+	return a.executeMode(tf, path, req, env)
+}
+
+// executeMode runs the terraform command sequence for req.Mode against an
+// already-initialized working directory.
+func (a *App) executeMode(tf, path string, req *Request, env []string) error {
+	switch req.Mode {
+	case ModePlan:
+		_, err := a.plan(tf, path, req, env)
 		return err
+	case ModePlanApply:
+		if _, err := a.plan(tf, path, req, env); err != nil {
+			return err
+		}
+		return a.runApply(tf, path, req, env, "tfplan")
+	case ModeDestroy:
+		return a.runTf(tf, path, req, env, "apply", "-destroy", "-input=false", "-auto-approve", "-no-color", "-json")
+	case ModeApply, "":
+		if req.PlanKey != "" {
+			if err := a.downloadPlan(path, req); err != nil {
+				return err
+			}
+			return a.runApply(tf, path, req, env, "tfplan")
+		}
+		return a.runApply(tf, path, req, env)
+	default:
+		return fmt.Errorf("unknown request mode %q", req.Mode)
 	}
+}
 
-	return apply.Wait()
+func (a *App) runApply(tf, path string, req *Request, env []string, extraArgs ...string) error {
+	args := append([]string{"apply", "-input=false", "-auto-approve", "-no-color", "-json"}, extraArgs...)
+
+	return a.runTf(tf, path, req, env, args...)
 }
 
 func (a *App) checkout(repoURL string, path string, version string) error {
-	var auth ghttp.BasicAuth
-	if len(a.token) > 0 {
-		auth = ghttp.BasicAuth{Username: "git", Password: a.token}
+	auth, err := a.auth(repoURL)
+	if err != nil {
+		return err
 	}
 
-	err := os.RemoveAll(path)
+	err = os.RemoveAll(path)
 	if err != nil {
 		log.Printf("failed to remove old repository directory: %s -> %v", path, err)
 	}
@@ -236,7 +263,7 @@ func (a *App) checkout(repoURL string, path string, version string) error {
 	repo, err := git.PlainClone(path, false, &git.CloneOptions{
 		URL:  repoURL,
 		Tags: git.AllTags,
-		Auth: &auth,
+		Auth: auth,
 	})
 	if err != nil {
 		return fmt.Errorf("failed clone repository: %w", err)
@@ -257,16 +284,16 @@ func (a *App) checkout(repoURL string, path string, version string) error {
 	return nil
 }
 
-func (a *App) getModules(path string) error {
-	modules, err := readModules(path)
+func (a *App) getModules(dir string) error {
+	modules, err := readModules(dir)
 	if err != nil {
 		return err
 	}
 
-	modpath := filepath.Join(filepath.Dir(path), ".terraform", "modules")
+	modpath := filepath.Join(dir, ".terraform", "modules")
 
 	for _, m := range modules {
-		u, ref, err := normalizedSource(m.Source)
+		u, ref, err := normalizedSource(m)
 		if err != nil {
 			return err
 		}
@@ -291,103 +318,14 @@ func (a *App) getModules(path string) error {
 	return nil
 }
 
-func normalizedSource(source string) (string, string, error) {
-	u, err := url.Parse(source)
+func (a *App) createBackend(path, name string) error {
+	hcl, err := a.storage.BackendHCL(name)
 	if err != nil {
-		return "", "", fmt.Errorf("failed to parse source URL: %w", err)
-	}
-
-	u.Scheme = "https"
-
-	ref := ""
-	if v, ok := u.Query()["ref"]; ok {
-		ref = v[0]
-	}
-
-	// drop anything after a .git
-	n := strings.Index(u.Path, ".git")
-	if n > -1 {
-		u.Path = u.Path[:n]
-	}
-
-	u.RawQuery = ""
-
-	return u.String(), ref, nil
-}
-
-type Module struct {
-	Key     string
-	Source  string
-	Dir     string
-	RootDir string `json:"-"`
-}
-
-func readModules(path string) ([]Module, error) {
-	r := regexp.MustCompile(`module "(.*)" {\s+source\s+=\s+"(.*)"`)
-
-	content, err := ioutil.ReadFile(filepath.Clean(path))
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file %s -> %w", path, err)
-	}
-
-	matches := r.FindAllStringSubmatch(string(content), -1)
-	if len(matches) == 0 {
-		return nil, fmt.Errorf("failed to find a module in %s", path)
-	}
-
-	var modules []Module
-	for _, match := range matches {
-		dir := fmt.Sprintf(".terraform/modules/%s", match[1])
-		rootDir := dir
-
-		source := match[2]
-		u, err := url.Parse(source)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse URL for module source %s -> %w", source, err)
-		}
-
-		n := strings.Index(u.Path, ".git")
-		if n > -1 {
-			// grab anything after .git, split it and join it back together to remove any duplicate slashes
-			// append it to the dir to ensure terraform respects the subdir
-			dir = filepath.Join(dir, filepath.Join(strings.Split(u.Path[n+4:], "/")...))
-		}
-
-		modules = append(modules, Module{
-			Key:     match[1],
-			Source:  match[2],
-			Dir:     dir,
-			RootDir: rootDir,
-		})
+		return fmt.Errorf("failed to render backend config: %w", err)
 	}
 
-	return modules, nil
-}
-
-func (a *App) createGitConfig(path string) error {
-	content := fmt.Sprintf("[url \"https://%s@github.com\"]\n\tinsteadOf = https://github.com\n", a.token)
-
-	err := os.WriteFile(path, []byte(content), 0600)
-	if err != nil {
-		return fmt.Errorf("failed to write %s -> %w", path, err)
-	}
-
-	return nil
-}
-
-func (a *App) createBackend(creds credentials.Value, path, name string) error {
 	p := filepath.Join(path, "backend.tf")
-	err := os.WriteFile(p, []byte(fmt.Sprintf(`terraform {
-			backend "s3" {
-				bucket     = "%s"
-				key        = "%s.tfstate"
-				region     = "%s"
-				access_key = "%s"
-				secret_key = "%s"
-				token      = "%s"
-			}
-	}`, a.bucket, name, aws.StringValue(a.sess.Config.Region),
-		creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken)), 0600)
+	err = os.WriteFile(p, []byte(hcl), 0600)
 	if err != nil {
 		return fmt.Errorf("failed to write %s: %w", p, err)
 	}
@@ -442,8 +380,13 @@ func getEnv(m map[string]interface{}) (vars []string) {
 	return
 }
 
-func (a *App) runTf(cwd string, req *Request, env []string, args ...string) (*exec.Cmd, error) {
-	cmd := exec.Command(a.tf, args...) // #nosec
+// runTf runs terraform to completion, draining its stdout/stderr as it
+// goes, and returns once the process has exited. It is the sole caller of
+// cmd.Wait: exec.Cmd.Wait must not be called more than once, so runTf
+// always waits on the process itself rather than handing the *exec.Cmd back
+// for the caller to wait on independently.
+func (a *App) runTf(tf, cwd string, req *Request, env []string, args ...string) error {
+	cmd := exec.Command(tf, args...) // #nosec
 	cmd.Env = env
 	cmd.Dir = cwd
 	// grab the output pipes so we can prepend the job
@@ -451,68 +394,26 @@ func (a *App) runTf(cwd string, req *Request, env []string, args ...string) (*ex
 	// which message belongs to which job
 	stdoutP, err := cmd.StdoutPipe()
 	if err != nil {
-		return nil, fmt.Errorf("failed to open stdout pipe: %v", err)
+		return fmt.Errorf("failed to open stdout pipe: %v", err)
 	}
 	stderrP, err := cmd.StderrPipe()
 	if err != nil {
-		return nil, fmt.Errorf("failed to open stdout pipe: %v", err)
+		return fmt.Errorf("failed to open stderr pipe: %v", err)
 	}
 
 	err = cmd.Start()
 	if err != nil {
-		return nil, fmt.Errorf("failed to start process: %s -> %v", a.tf, err)
+		return fmt.Errorf("failed to start process: %s -> %v", tf, err)
 	}
 
-	go func() {
-		err := a.readOutput(req.Name, stdoutP, stderrP)
-		if err != nil {
-			log.Printf("[ERROR] %v", err)
-		}
-		err = cmd.Wait()
-		if err != nil {
-			log.Printf("[ERROR] %v", err)
-		}
-	}()
-
-	return cmd, nil
-}
-
-func (a *App) readOutput(name string, stdout, stderr io.Reader) error {
-	stdoutScanner := bufio.NewScanner(stdout)
-	stderrScanner := bufio.NewScanner(stderr)
-
-	// In order to read the output pipes we use a bufio.Scanner
-	// which by default reads a line on each pass so we start
-	// our wrapping func in a go routine for each pipe
-	wg := &sync.WaitGroup{}
-	wg.Add(2)
-	go a.wrapOutput(name, os.Stdout, stdoutScanner, wg)
-	go a.wrapOutput(name, os.Stderr, stderrScanner, wg)
-
-	// block until the process has stopped writing to the pipe
-	wg.Wait()
-
-	// if something goes wrong return the error to the caller
-	if err := stdoutScanner.Err(); err != nil {
-		return fmt.Errorf("stdoutScanner failed: %v", err)
+	phase := ""
+	if len(args) > 0 {
+		phase = args[0]
 	}
-	if err := stderrScanner.Err(); err != nil {
-		return fmt.Errorf("stderrScanner failed: %v", err)
-	}
-
-	return nil
-}
 
-func (a *App) wrapOutput(name string, out io.Writer, s *bufio.Scanner, wg *sync.WaitGroup) {
-	// Scan pulls one line from the pipe
-	// so we can wrap it with the job name
-	for s.Scan() {
-		_, err := fmt.Fprintf(out, "[%s]: %s\n", name, s.Text())
-		if err != nil {
-			log.Printf("failed to Fprintf: %v\n", err)
-		}
+	if err := a.readOutput(req, phase, stdoutP, stderrP); err != nil {
+		log.Printf("[ERROR] %v", err)
 	}
 
-	// decrement the waitgroup
-	wg.Done()
+	return cmd.Wait()
 }
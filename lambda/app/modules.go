@@ -0,0 +1,107 @@
+package app
+
+import (
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/terraform-config-inspect/tfconfig"
+)
+
+// Module is a single `module` block discovered in a checked-out
+// configuration, along with the local path it will be checked out to.
+type Module struct {
+	Key     string
+	Source  string
+	Version string
+	Dir     string
+	RootDir string `json:"-"`
+}
+
+// readModules walks every *.tf file in dir and returns the module blocks
+// it declares, including any version constraint, so callers don't need to
+// special-case heredocs, multi-line attributes, or for_each/count.
+func readModules(dir string) ([]Module, error) {
+	mod, diags := tfconfig.LoadModule(dir)
+	if diags.HasErrors() {
+		return nil, fmt.Errorf("failed to parse modules in %s: %w", dir, diags.Err())
+	}
+
+	if len(mod.ModuleCalls) == 0 {
+		return nil, fmt.Errorf("failed to find a module in %s", dir)
+	}
+
+	var modules []Module
+	for key, mc := range mod.ModuleCalls {
+		modDir := fmt.Sprintf(".terraform/modules/%s", key)
+		rootDir := modDir
+
+		if u, err := url.Parse(mc.Source); err == nil {
+			// grab anything after .git, split it and join it back together to remove any duplicate slashes
+			// append it to the dir to ensure terraform respects the subdir
+			if n := strings.Index(u.Path, ".git"); n > -1 {
+				modDir = filepath.Join(modDir, filepath.Join(strings.Split(u.Path[n+4:], "/")...))
+			}
+		}
+
+		modules = append(modules, Module{
+			Key:     key,
+			Source:  mc.Source,
+			Version: mc.Version,
+			Dir:     modDir,
+			RootDir: rootDir,
+		})
+	}
+
+	return modules, nil
+}
+
+// normalizedSource turns a module's source into a git URL and ref that
+// checkout can clone, resolving registry sources (namespace/name/provider)
+// through the Terraform registry protocol first.
+func normalizedSource(m Module) (string, string, error) {
+	source := m.Source
+	if isRegistrySource(source) {
+		resolved, err := resolveRegistrySource(source)
+		if err != nil {
+			return "", "", err
+		}
+		source = resolved
+	}
+
+	// go-getter style "git::" forcing prefixes are only needed to
+	// disambiguate from the registry protocol, go-git doesn't need them.
+	source = strings.TrimPrefix(source, "git::")
+
+	// scp-like git@host:path sources aren't valid URLs, rewrite them as ssh://
+	if strings.HasPrefix(source, "git@") && !strings.Contains(source, "://") {
+		source = "ssh://" + strings.Replace(source, ":", "/", 1)
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to parse source URL: %w", err)
+	}
+
+	// keep ssh sources on ssh so checkout picks the SSH transport for them
+	if u.Scheme != "ssh" {
+		u.Scheme = "https"
+	}
+
+	ref := ""
+	if v, ok := u.Query()["ref"]; ok {
+		ref = v[0]
+	} else if m.Version != "" {
+		ref = m.Version
+	}
+
+	// drop anything after a .git
+	if n := strings.Index(u.Path, ".git"); n > -1 {
+		u.Path = u.Path[:n]
+	}
+
+	u.RawQuery = ""
+
+	return u.String(), ref, nil
+}
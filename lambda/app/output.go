@@ -0,0 +1,209 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// actionsBuffer collects one request's GitHub Actions workflow commands
+// (::group:: and annotations) so they can be flushed to stdout as a single
+// atomic write. Without this, concurrently-executing requests in actions
+// mode (see Consume) would interleave their ::group::/::endgroup:: pairs
+// and annotations on the shared stdout stream, which GitHub Actions doesn't
+// support. Safe for concurrent use since both the stdout and stderr readers
+// of a single request write into it. ::add-mask:: commands are NOT buffered
+// here; see maskSecrets.
+type actionsBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *actionsBuffer) printf(format string, args ...interface{}) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fmt.Fprintf(&b.buf, format, args...)
+}
+
+// writeLine writes s to out under stdoutMu. Individual writes to a shared
+// stream from concurrent goroutines aren't guaranteed not to interleave, so
+// every write to stdout - these per-line logs as well as flushActions'
+// buffered blocks - goes through the same lock.
+func (a *App) writeLine(out io.Writer, s string) {
+	a.stdoutMu.Lock()
+	defer a.stdoutMu.Unlock()
+	if _, err := fmt.Fprint(out, s); err != nil {
+		log.Printf("failed to write output: %v\n", err)
+	}
+}
+
+// flushActions writes req's accumulated workflow commands to stdout in one
+// write, under a lock shared by every request so two flushes can never
+// interleave.
+func (a *App) flushActions(req *Request) {
+	if req.actions == nil {
+		return
+	}
+
+	req.actions.printf("::endgroup::\n")
+
+	a.stdoutMu.Lock()
+	defer a.stdoutMu.Unlock()
+	if _, err := os.Stdout.Write(req.actions.buf.Bytes()); err != nil {
+		log.Printf("failed to write actions output for %s: %v", req.Name, err)
+	}
+}
+
+// tfMessage is the subset of Terraform's `-json` log format the executor
+// cares about. See https://developer.hashicorp.com/terraform/internals/machine-readable-ui.
+type tfMessage struct {
+	Level      string `json:"@level"`
+	Message    string `json:"@message"`
+	Type       string `json:"type"`
+	Diagnostic *struct {
+		Severity string `json:"severity"`
+		Summary  string `json:"summary"`
+		Range    *struct {
+			Filename string `json:"filename"`
+		} `json:"range"`
+	} `json:"diagnostic"`
+	Hook *struct {
+		Resource struct {
+			Addr string `json:"addr"`
+		} `json:"resource"`
+	} `json:"hook"`
+}
+
+// logEvent is the structured event the executor emits for every line of
+// Terraform output, correlating it back to the request that produced it.
+type logEvent struct {
+	RequestID   string `json:"request.id"`
+	RequestName string `json:"request.name"`
+	Phase       string `json:"phase"`
+	Level       string `json:"level,omitempty"`
+	Resource    string `json:"resource,omitempty"`
+	Severity    string `json:"severity,omitempty"`
+	Message     string `json:"message"`
+}
+
+func (a *App) readOutput(req *Request, phase string, stdout, stderr io.Reader) error {
+	stdoutScanner := bufio.NewScanner(stdout)
+	stderrScanner := bufio.NewScanner(stderr)
+
+	// In order to read the output pipes we use a bufio.Scanner
+	// which by default reads a line on each pass so we start
+	// our wrapping func in a go routine for each pipe
+	wg := &sync.WaitGroup{}
+	wg.Add(2)
+	go a.wrapOutput(req, phase, os.Stdout, stdoutScanner, wg)
+	go a.wrapOutput(req, phase, os.Stderr, stderrScanner, wg)
+
+	// block until the process has stopped writing to the pipe
+	wg.Wait()
+
+	// if something goes wrong return the error to the caller
+	if err := stdoutScanner.Err(); err != nil {
+		return fmt.Errorf("stdoutScanner failed: %v", err)
+	}
+	if err := stderrScanner.Err(); err != nil {
+		return fmt.Errorf("stderrScanner failed: %v", err)
+	}
+
+	return nil
+}
+
+func (a *App) wrapOutput(req *Request, phase string, out io.Writer, s *bufio.Scanner, wg *sync.WaitGroup) {
+	// Scan pulls one line from the pipe so we can correlate it with the
+	// request and phase that produced it
+	for s.Scan() {
+		line := s.Text()
+
+		var msg tfMessage
+		if err := json.Unmarshal([]byte(line), &msg); err != nil {
+			// not a -json line (e.g. a provider logging straight to stderr), pass it through as-is
+			a.writeLine(out, fmt.Sprintf("[%s]: %s\n", req.Name, line))
+			continue
+		}
+
+		evt := logEvent{
+			RequestID:   req.ID,
+			RequestName: req.Name,
+			Phase:       phase,
+			Level:       msg.Level,
+			Message:     msg.Message,
+		}
+		if msg.Hook != nil {
+			evt.Resource = msg.Hook.Resource.Addr
+		}
+		if msg.Diagnostic != nil {
+			evt.Severity = msg.Diagnostic.Severity
+			evt.Message = msg.Diagnostic.Summary
+		}
+
+		b, err := json.Marshal(evt)
+		if err != nil {
+			log.Printf("failed to marshal log event: %v\n", err)
+			continue
+		}
+		a.writeLine(out, string(b)+"\n")
+
+		if a.actionsMode {
+			emitWorkflowCommand(req, msg)
+		}
+	}
+
+	// decrement the waitgroup
+	wg.Done()
+}
+
+// emitWorkflowCommand maps a Terraform diagnostic onto the matching GitHub
+// Actions workflow command so it surfaces in the job's annotations.
+func emitWorkflowCommand(req *Request, msg tfMessage) {
+	if msg.Diagnostic == nil {
+		return
+	}
+
+	file := ""
+	if msg.Diagnostic.Range != nil {
+		file = msg.Diagnostic.Range.Filename
+	}
+
+	switch msg.Diagnostic.Severity {
+	case "error":
+		req.actions.printf("::error file=%s::%s\n", file, msg.Diagnostic.Summary)
+	case "warning":
+		req.actions.printf("::warning file=%s::%s\n", file, msg.Diagnostic.Summary)
+	default:
+		req.actions.printf("::notice file=%s::%s\n", file, msg.Diagnostic.Summary)
+	}
+}
+
+// maskSecrets emits GitHub Actions `::add-mask::` commands for the assumed
+// role credentials and any request variables flagged sensitive, so they
+// never appear unredacted in the job log. Unlike the rest of req.actions,
+// these are written to stdout immediately rather than buffered until
+// flushActions: GitHub Actions only masks a value in output it sees *after*
+// the ::add-mask:: command, so a mask that arrives after the credential has
+// already streamed out in terraform's live log (e.g. under TF_LOG=trace)
+// is too late to do anything.
+func (a *App) maskSecrets(cred *sts.Credentials, req *Request) {
+	for _, v := range []string{aws.StringValue(cred.AccessKeyId), aws.StringValue(cred.SecretAccessKey), aws.StringValue(cred.SessionToken)} {
+		if v != "" {
+			a.writeLine(os.Stdout, fmt.Sprintf("::add-mask::%s\n", v))
+		}
+	}
+
+	for _, key := range req.SensitiveVariables {
+		if v, ok := req.Variables[key]; ok {
+			a.writeLine(os.Stdout, fmt.Sprintf("::add-mask::%v\n", v))
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package app
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// planSummary is the machine-readable result of a plan, logged as a
+// structured event and returned to callers that run a plan synchronously.
+type planSummary struct {
+	RequestID   string   `json:"request.id"`
+	RequestName string   `json:"request.name"`
+	PlanKey     string   `json:"plan_key"`
+	Add         int      `json:"add"`
+	Change      int      `json:"change"`
+	Destroy     int      `json:"destroy"`
+	Resources   []string `json:"resources"`
+}
+
+// tfPlanJSON is the subset of `terraform show -json`'s plan representation
+// needed to summarize adds/changes/destroys.
+// See https://developer.hashicorp.com/terraform/internals/json-format#plan-representation.
+type tfPlanJSON struct {
+	ResourceChanges []struct {
+		Address string `json:"address"`
+		Change  struct {
+			Actions []string `json:"actions"`
+		} `json:"change"`
+	} `json:"resource_changes"`
+}
+
+// plan runs `terraform plan`, uploads the resulting plan file and its JSON
+// representation to the configured blob storage under
+// {name}/{id}/{timestamp}, and returns a summary of the proposed changes.
+func (a *App) plan(tf, path string, req *Request, env []string) (planSummary, error) {
+	if err := a.runTf(tf, path, req, env, "plan", "-out=tfplan", "-input=false", "-no-color", "-json"); err != nil {
+		return planSummary{}, err
+	}
+
+	showJSON, err := a.tfOutput(tf, path, env, "show", "-json", "tfplan")
+	if err != nil {
+		return planSummary{}, err
+	}
+
+	summary, err := summarizePlan(showJSON)
+	if err != nil {
+		return planSummary{}, err
+	}
+	summary.RequestID = req.ID
+	summary.RequestName = req.Name
+
+	planFile, err := os.ReadFile(filepath.Clean(filepath.Join(path, "tfplan")))
+	if err != nil {
+		return planSummary{}, fmt.Errorf("failed to read tfplan: %w", err)
+	}
+
+	prefix := fmt.Sprintf("%s/%s/%s", req.Name, req.ID, time.Now().UTC().Format("20060102T150405Z"))
+	summary.PlanKey = prefix + "/tfplan"
+
+	ctx := context.Background()
+	if err := a.storage.Upload(ctx, summary.PlanKey, bytes.NewReader(planFile)); err != nil {
+		return planSummary{}, err
+	}
+	if err := a.storage.Upload(ctx, prefix+"/plan.json", bytes.NewReader(showJSON)); err != nil {
+		return planSummary{}, err
+	}
+
+	b, err := json.Marshal(summary)
+	if err != nil {
+		return planSummary{}, fmt.Errorf("failed to marshal plan summary: %w", err)
+	}
+	log.Println(string(b))
+
+	return summary, nil
+}
+
+// downloadPlan fetches a previously uploaded plan file by its storage key
+// and writes it to path/tfplan so it can be applied directly.
+func (a *App) downloadPlan(path string, req *Request) error {
+	r, err := a.storage.Download(context.Background(), req.PlanKey)
+	if err != nil {
+		return fmt.Errorf("failed to download plan %s: %w", req.PlanKey, err)
+	}
+	defer r.Close()
+
+	f, err := os.Create(filepath.Join(path, "tfplan"))
+	if err != nil {
+		return fmt.Errorf("failed to create tfplan: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.ReadFrom(r); err != nil {
+		return fmt.Errorf("failed to write tfplan: %w", err)
+	}
+
+	return nil
+}
+
+func summarizePlan(b []byte) (planSummary, error) {
+	var plan tfPlanJSON
+	if err := json.Unmarshal(b, &plan); err != nil {
+		return planSummary{}, fmt.Errorf("failed to parse plan JSON: %w", err)
+	}
+
+	var summary planSummary
+	for _, rc := range plan.ResourceChanges {
+		summary.Resources = append(summary.Resources, rc.Address)
+		for _, action := range rc.Change.Actions {
+			switch action {
+			case "create":
+				summary.Add++
+			case "update":
+				summary.Change++
+			case "delete":
+				summary.Destroy++
+			}
+		}
+	}
+
+	return summary, nil
+}
+
+// tfOutput runs terraform and returns its captured stdout, for commands
+// like `show -json` whose output is a single document rather than a
+// stream of -json log lines.
+func (a *App) tfOutput(tf, cwd string, env []string, args ...string) ([]byte, error) {
+	cmd := exec.Command(tf, args...) // #nosec
+	cmd.Env = env
+	cmd.Dir = cwd
+
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to run terraform %v: %w", args, err)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,201 @@
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// enqueue sends a single request onto the work queue, tagging it with its
+// request ID as a message attribute for CloudWatch correlation.
+func (a *App) enqueue(ctx context.Context, req *Request) error {
+	b, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request %s: %w", req.Name, err)
+	}
+
+	_, err = a.sqs.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:    aws.String(a.queueURL),
+		MessageBody: aws.String(string(b)),
+		MessageAttributes: map[string]*sqs.MessageAttributeValue{
+			"RequestID": {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(req.ID),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to enqueue request %s: %w", req.Name, err)
+	}
+
+	return nil
+}
+
+// Consume drains the work queue until ctx is cancelled, running up to
+// a.cpus executions concurrently. A failed execution is left on the queue so
+// SQS's visibility timeout makes it eligible for redelivery; once a message
+// that has been received maxReceiveCount times fails again, handleMessage
+// moves it to dlqURL itself instead of relying on a queue-level redrive
+// policy.
+func (a *App) Consume(ctx context.Context) error {
+	sem := make(chan struct{}, a.cpus)
+	var wg sync.WaitGroup
+
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return nil
+		default:
+		}
+
+		out, err := a.sqs.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(a.queueURL),
+			MaxNumberOfMessages: aws.Int64(10),
+			WaitTimeSeconds:     aws.Int64(20),
+			AttributeNames:      []*string{aws.String("ApproximateReceiveCount")},
+		})
+		if err != nil {
+			log.Printf("failed to receive messages: %v", err)
+			continue
+		}
+
+		for _, msg := range out.Messages {
+			msg := msg
+			sem <- struct{}{}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				a.handleMessage(ctx, msg)
+			}()
+		}
+	}
+}
+
+// visibilityHeartbeat is how often handleMessage extends a message's
+// visibility timeout while execute runs. terraform apply/destroy can run
+// well past a queue's configured visibility timeout, so without this a
+// long-running job's message becomes visible again and gets picked up by a
+// second consumer, producing two concurrent applies against the same state.
+const visibilityHeartbeat = 2 * time.Minute
+
+// visibilityExtension is how far out each heartbeat pushes the timeout, so
+// the next heartbeat tick can run up to visibilityExtension -
+// visibilityHeartbeat (3 minutes) late before the message would become
+// visible again.
+const visibilityExtension = int64(5 * time.Minute / time.Second)
+
+func (a *App) handleMessage(ctx context.Context, msg *sqs.Message) {
+	var req Request
+	err := json.Unmarshal([]byte(aws.StringValue(msg.Body)), &req)
+	if err != nil {
+		log.Printf("failed to unmarshal message: %v", err)
+		return
+	}
+
+	stop := a.keepAlive(ctx, msg, req.Name)
+	defer stop()
+
+	err = a.execute(&req)
+	if err != nil {
+		log.Printf("failed to execute: %s -> %v", req.Name, err)
+
+		if a.exhausted(msg) {
+			a.deadLetter(ctx, msg, req)
+		}
+
+		return
+	}
+
+	_, err = a.sqs.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(a.queueURL),
+		ReceiptHandle: msg.ReceiptHandle,
+	})
+	if err != nil {
+		log.Printf("failed to delete message for request %s: %v", req.Name, err)
+	}
+}
+
+// keepAlive extends msg's visibility timeout every visibilityHeartbeat until
+// the returned stop func is called, so a long-running execute doesn't let
+// the message become visible again and get picked up by another consumer.
+func (a *App) keepAlive(ctx context.Context, msg *sqs.Message, name string) (stop func()) {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(visibilityHeartbeat)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_, err := a.sqs.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+					QueueUrl:          aws.String(a.queueURL),
+					ReceiptHandle:     msg.ReceiptHandle,
+					VisibilityTimeout: aws.Int64(visibilityExtension),
+				})
+				if err != nil {
+					log.Printf("failed to extend visibility timeout for request %s: %v", name, err)
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// exhausted reports whether msg has already been received at least
+// maxReceiveCount times, meaning this handleMessage call is its last chance
+// to be retried before it should be dead-lettered.
+func (a *App) exhausted(msg *sqs.Message) bool {
+	if a.maxReceiveCount <= 0 {
+		return false
+	}
+
+	count, err := strconv.Atoi(aws.StringValue(msg.Attributes["ApproximateReceiveCount"]))
+	if err != nil {
+		return false
+	}
+
+	return count >= a.maxReceiveCount
+}
+
+// deadLetter moves a message that has exhausted its retries to dlqURL, if
+// one is configured, and removes it from the work queue either way so it
+// stops being redelivered.
+func (a *App) deadLetter(ctx context.Context, msg *sqs.Message, req Request) {
+	if a.dlqURL != "" {
+		_, err := a.sqs.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+			QueueUrl:    aws.String(a.dlqURL),
+			MessageBody: msg.Body,
+			MessageAttributes: map[string]*sqs.MessageAttributeValue{
+				"RequestID": {
+					DataType:    aws.String("String"),
+					StringValue: aws.String(req.ID),
+				},
+			},
+		})
+		if err != nil {
+			log.Printf("failed to dead-letter request %s: %v", req.Name, err)
+			return
+		}
+	}
+
+	_, err := a.sqs.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(a.queueURL),
+		ReceiptHandle: msg.ReceiptHandle,
+	})
+	if err != nil {
+		log.Printf("failed to delete exhausted message for request %s: %v", req.Name, err)
+	}
+}
@@ -0,0 +1,65 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// isRegistrySource reports whether source looks like a Terraform registry
+// address (`[host/]namespace/name/provider`) rather than a direct URL.
+func isRegistrySource(source string) bool {
+	if strings.Contains(source, "://") || strings.Contains(source, "::") {
+		return false
+	}
+
+	parts := strings.Split(source, "/")
+	if len(parts) != 3 && len(parts) != 4 {
+		return false
+	}
+
+	// The namespace segment is parts[0] for a bare registry address, or
+	// parts[1] when parts[0] is a private registry host. Registry
+	// namespaces can't contain a dot, so checking this rules out scheme-less
+	// git shorthand like github.com/hashicorp/example, which otherwise has
+	// the same segment count as a genuine registry address.
+	namespace := parts[0]
+	if len(parts) == 4 {
+		namespace = parts[1]
+	}
+
+	return !strings.Contains(namespace, ".")
+}
+
+// resolveRegistrySource resolves a registry address to the underlying
+// module source using the Terraform registry protocol's download endpoint,
+// which returns the real location in the X-Terraform-Get response header.
+func resolveRegistrySource(source string) (string, error) {
+	host := "registry.terraform.io"
+	parts := strings.Split(source, "/")
+	if len(parts) == 4 {
+		host = parts[0]
+		parts = parts[1:]
+	}
+
+	u := fmt.Sprintf("https://%s/v1/modules/%s/%s/%s/download", host, parts[0], parts[1], parts[2])
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(u) // #nosec
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve registry module %s: %w", source, err)
+	}
+	defer resp.Body.Close()
+
+	loc := resp.Header.Get("X-Terraform-Get")
+	if loc == "" {
+		return "", fmt.Errorf("registry did not return a download location for %s", source)
+	}
+
+	return loc, nil
+}
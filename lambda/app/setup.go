@@ -2,6 +2,10 @@ package app
 
 import (
 	"archive/zip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
@@ -9,50 +13,201 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+
+	"github.com/hashicorp/go-version"
 )
 
-func getTerraform(version string) (string, error) {
-	vers := version
-	if strings.EqualFold(vers, "latest") {
-		var err error
-		vers, err = latest()
+const releasesIndexURL = "https://releases.hashicorp.com/terraform/index.json"
+
+// releaseIndex is the subset of releases.hashicorp.com/terraform/index.json
+// needed to resolve a version constraint to a concrete release.
+type releaseIndex struct {
+	Versions map[string]struct {
+		Builds []struct {
+			OS   string `json:"os"`
+			Arch string `json:"arch"`
+			URL  string `json:"url"`
+		} `json:"builds"`
+	} `json:"versions"`
+}
+
+// resolveTerraform returns the path to a terraform binary satisfying
+// constraint (e.g. "~> 1.5", ">= 1.3, < 2.0", or "" for the latest
+// release), downloading and caching it if it isn't already available.
+func (a *App) resolveTerraform(constraint string) (string, error) {
+	a.tfMu.Lock()
+	defer a.tfMu.Unlock()
+
+	v, err := resolveVersion(constraint)
+	if err != nil {
+		return "", err
+	}
+
+	dest := filepath.Join("/tmp", fmt.Sprintf("terraform_%s", v))
+	if _, err := os.Stat(dest); err == nil {
+		return dest, nil
+	}
+
+	ctx := context.Background()
+	if a.tfCache != nil {
+		ok, err := a.tfCache.get(ctx, v, dest)
 		if err != nil {
 			return "", err
 		}
+		if ok {
+			if err := os.Chmod(dest, 0750); err != nil { // #nosec
+				return "", fmt.Errorf("failed to make terraform executable: %w", err)
+			}
+			return dest, nil
+		}
 	}
 
-	u := fmt.Sprintf("https://releases.hashicorp.com/terraform/%s/terraform_%s_linux_amd64.zip",
-		vers, vers)
-	err := downloadFile(u, `/tmp/terraform.zip`)
-	if err != nil {
+	if err := downloadTerraform(v, dest); err != nil {
 		return "", err
 	}
 
-	files, err := unzip(`/tmp/terraform.zip`, `/tmp`)
-	if err != nil {
-		return "", err
+	if a.tfCache != nil {
+		if err := a.tfCache.put(ctx, v, dest); err != nil {
+			log.Printf("failed to cache terraform %s: %v", v, err)
+		}
 	}
-	err = os.Remove("/tmp/terraform.zip")
+
+	return dest, nil
+}
+
+// resolveVersion picks the highest terraform release satisfying
+// constraint from the releases.hashicorp.com index, or the latest release
+// if constraint is empty.
+func resolveVersion(constraint string) (string, error) {
+	constraints, err := version.NewConstraint(constraint)
+	if constraint != "" && err != nil {
+		return "", fmt.Errorf("invalid version constraint %q: %w", constraint, err)
+	}
+
+	resp, err := http.Get(releasesIndexURL) // #nosec
 	if err != nil {
-		return "", fmt.Errorf("failed to remove /tmp/terraform.zip: %w", err)
+		return "", fmt.Errorf("failed to fetch terraform release index: %w", err)
 	}
+	defer resp.Body.Close()
 
-	for _, f := range files {
-		fi, err := os.Stat(f)
+	var idx releaseIndex
+	if err := json.NewDecoder(resp.Body).Decode(&idx); err != nil {
+		return "", fmt.Errorf("failed to decode terraform release index: %w", err)
+	}
+
+	var best *version.Version
+	for raw := range idx.Versions {
+		v, err := version.NewVersion(raw)
 		if err != nil {
-			return "", fmt.Errorf("failed to stat file %s -> %w", f, err)
+			// not a version go-version can parse
+			continue
 		}
+		// skip pre-releases, e.g. a beta or rc
+		if v.Prerelease() != "" {
+			continue
+		}
+		if constraint != "" && !constraints.Check(v) {
+			continue
+		}
+		if best == nil || v.GreaterThan(best) {
+			best = v
+		}
+	}
+	if best == nil {
+		return "", fmt.Errorf("no terraform release satisfies %q", constraint)
+	}
+
+	return best.Original(), nil
+}
+
+// downloadTerraform downloads the linux/amd64 terraform zip for version,
+// verifies it against the published SHA256SUMS, and extracts the binary
+// to dest.
+func downloadTerraform(v, dest string) error {
+	name := fmt.Sprintf("terraform_%s_linux_amd64.zip", v)
+	zipPath := filepath.Join("/tmp", name)
+
+	err := downloadFile(fmt.Sprintf("https://releases.hashicorp.com/terraform/%s/%s", v, name), zipPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(zipPath) // #nosec
+
+	err = verifyChecksum(v, name, zipPath)
+	if err != nil {
+		return err
+	}
 
-		if fi.IsDir() {
+	dir, err := os.MkdirTemp("/tmp", "terraform_extract_")
+	if err != nil {
+		return fmt.Errorf("failed to create extraction directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	files, err := unzip(zipPath, dir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		if filepath.Base(f) != "terraform" {
 			continue
 		}
 
-		if filepath.Base(f) == "terraform" {
-			return f, nil
+		if err := copyFile(f, dest); err != nil {
+			return err
 		}
+
+		return os.Chmod(dest, 0750) // #nosec
 	}
 
-	return "", fmt.Errorf("failed to find terraform binary in zip")
+	return fmt.Errorf("failed to find terraform binary in zip")
+}
+
+// verifyChecksum checks zipPath's SHA256 against the SHA256SUMS file
+// HashiCorp publishes alongside each release.
+func verifyChecksum(v, name, zipPath string) error {
+	u := fmt.Sprintf("https://releases.hashicorp.com/terraform/%s/terraform_%s_SHA256SUMS", v, v)
+
+	resp, err := http.Get(u) // #nosec
+	if err != nil {
+		return fmt.Errorf("failed to fetch SHA256SUMS for terraform %s: %w", v, err)
+	}
+	defer resp.Body.Close()
+
+	sums, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read SHA256SUMS for terraform %s: %w", v, err)
+	}
+
+	var want string
+	for _, line := range strings.Split(string(sums), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[1] == name {
+			want = fields[0]
+			break
+		}
+	}
+	if want == "" {
+		return fmt.Errorf("%s not listed in SHA256SUMS for terraform %s", name, v)
+	}
+
+	f, err := os.Open(filepath.Clean(zipPath))
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", zipPath, err)
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return fmt.Errorf("failed to hash %s: %w", zipPath, err)
+	}
+
+	if got := hex.EncodeToString(h.Sum(nil)); got != want {
+		return fmt.Errorf("checksum mismatch for %s: got %s, want %s", name, got, want)
+	}
+
+	return nil
 }
 
 // using zip implementation from https://golangcode.com/unzip-files-in-go/
@@ -126,29 +281,6 @@ func unzip(src string, dest string) ([]string, error) {
 	return filenames, nil
 }
 
-func latest() (string, error) {
-	u := "https://github.com/hashicorp/terraform/releases/latest"
-
-	client := &http.Client{
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
-
-	resp, err := client.Head(u)
-	if err != nil {
-		return "", fmt.Errorf("failed to HEAD terraform repo: %w", err)
-	}
-	defer resp.Body.Close()
-
-	location, err := resp.Location()
-	if err != nil {
-		return "", fmt.Errorf("failed to get redirect location for terraform repo: %w", err)
-	}
-
-	return strings.TrimLeft(filepath.Base(location.String()), "v"), nil
-}
-
 func downloadFile(u string, path string) error {
 	resp, err := http.Get(u) // #nosec
 	if err != nil {
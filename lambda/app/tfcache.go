@@ -0,0 +1,143 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// tfCache persists resolved terraform binaries across cold starts, either
+// on an EFS mount shared between invocations or under an S3 prefix, so
+// warm invocations and sibling Lambdas can reuse them.
+type tfCache struct {
+	scheme string
+	dir    string // efs: local directory
+	bucket string // s3: bucket
+	prefix string // s3: key prefix
+	client *s3.S3
+}
+
+// newTFCache builds a tfCache from a TF_BIN_CACHE address such as
+// "efs:///mnt/tf" or "s3://bucket/prefix". An empty addr disables caching.
+func newTFCache(addr string, sess *session.Session) (*tfCache, error) {
+	if addr == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse TF_BIN_CACHE %q: %w", addr, err)
+	}
+
+	switch u.Scheme {
+	case "efs":
+		return &tfCache{scheme: "efs", dir: u.Path}, nil
+	case "s3":
+		return &tfCache{scheme: "s3", bucket: u.Host, prefix: strings.TrimPrefix(u.Path, "/"), client: s3.New(sess)}, nil
+	default:
+		return nil, fmt.Errorf("unsupported TF_BIN_CACHE scheme %q", u.Scheme)
+	}
+}
+
+func (c *tfCache) key(version string) string {
+	if c.prefix == "" {
+		return fmt.Sprintf("terraform_%s", version)
+	}
+
+	return fmt.Sprintf("%s/terraform_%s", c.prefix, version)
+}
+
+// get copies a cached binary for version to dest. ok is false on a cache
+// miss, in which case the caller should fall back to downloading it.
+func (c *tfCache) get(ctx context.Context, version, dest string) (ok bool, err error) {
+	switch c.scheme {
+	case "efs":
+		src := filepath.Join(c.dir, fmt.Sprintf("terraform_%s", version))
+		if _, err := os.Stat(src); err != nil {
+			return false, nil
+		}
+
+		return true, copyFile(src, dest)
+	case "s3":
+		out, err := c.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(c.bucket),
+			Key:    aws.String(c.key(version)),
+		})
+		if err != nil {
+			return false, nil
+		}
+		defer out.Body.Close()
+
+		f, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0750) // #nosec
+		if err != nil {
+			return false, fmt.Errorf("failed to open %s: %w", dest, err)
+		}
+		defer f.Close()
+
+		if _, err := f.ReadFrom(out.Body); err != nil {
+			return false, fmt.Errorf("failed to write %s: %w", dest, err)
+		}
+
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// put uploads the binary at src to the cache under version.
+func (c *tfCache) put(ctx context.Context, version, src string) error {
+	switch c.scheme {
+	case "efs":
+		if err := os.MkdirAll(c.dir, 0750); err != nil {
+			return fmt.Errorf("failed to create %s: %w", c.dir, err)
+		}
+
+		return copyFile(src, filepath.Join(c.dir, fmt.Sprintf("terraform_%s", version)))
+	case "s3":
+		f, err := os.Open(filepath.Clean(src))
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %w", src, err)
+		}
+		defer f.Close()
+
+		_, err = c.client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket: aws.String(c.bucket),
+			Key:    aws.String(c.key(version)),
+			Body:   f,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to cache terraform %s: %w", version, err)
+		}
+
+		return nil
+	default:
+		return nil
+	}
+}
+
+func copyFile(src, dest string) error {
+	in, err := os.Open(filepath.Clean(src))
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", src, err)
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dest, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0750) // #nosec
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", dest, err)
+	}
+	defer out.Close()
+
+	if _, err := out.ReadFrom(in); err != nil {
+		return fmt.Errorf("failed to copy %s to %s: %w", src, dest, err)
+	}
+
+	return nil
+}
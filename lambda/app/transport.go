@@ -0,0 +1,85 @@
+package app
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	ghttp "github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// isSSH reports whether repoURL should be cloned over SSH rather than
+// HTTPS, so module sources on different hosts can mix transports.
+func isSSH(repoURL string) bool {
+	return strings.HasPrefix(repoURL, "git@") || strings.HasPrefix(repoURL, "ssh://")
+}
+
+// auth builds the go-git auth method for repoURL, preferring the
+// configured SSH key for ssh:// and git@ sources and falling back to the
+// HTTPS token otherwise.
+func (a *App) auth(repoURL string) (transport.AuthMethod, error) {
+	if isSSH(repoURL) {
+		if a.sshKeyPath == "" {
+			return nil, nil
+		}
+
+		keys, err := ssh.NewPublicKeysFromFile(a.sshUser, a.sshKeyPath, a.sshKeyPassphrase)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load SSH key %s: %w", a.sshKeyPath, err)
+		}
+
+		if a.knownHosts != "" {
+			cb, err := ssh.NewKnownHostsCallback(a.knownHosts)
+			if err != nil {
+				return nil, fmt.Errorf("failed to load known_hosts %s: %w", a.knownHosts, err)
+			}
+			keys.HostKeyCallback = cb
+		}
+
+		return keys, nil
+	}
+
+	if a.token == "" {
+		return nil, nil
+	}
+
+	return &ghttp.BasicAuth{Username: "git", Password: a.token}, nil
+}
+
+// credentialEnv returns the env vars the terraform child process needs to
+// authenticate its own git invocations (e.g. resolving a module source it
+// wasn't pre-fetched for), in place of a plaintext token in .git/config.
+func (a *App) credentialEnv(path string) ([]string, error) {
+	if isSSH(a.repo) {
+		if a.sshKeyPath == "" {
+			return nil, nil
+		}
+
+		cmd := fmt.Sprintf("ssh -i %s -o IdentitiesOnly=yes", a.sshKeyPath)
+		if a.knownHosts != "" {
+			cmd += fmt.Sprintf(" -o UserKnownHostsFile=%s", a.knownHosts)
+		} else {
+			cmd += " -o StrictHostKeyChecking=no"
+		}
+
+		return []string{fmt.Sprintf("GIT_SSH_COMMAND=%s", cmd)}, nil
+	}
+
+	if a.token == "" {
+		return nil, nil
+	}
+
+	askpass := filepath.Join(path, ".git-askpass")
+	err := os.WriteFile(askpass, []byte(fmt.Sprintf("#!/bin/sh\necho %s\n", a.token)), 0700) // #nosec
+	if err != nil {
+		return nil, fmt.Errorf("failed to write %s: %w", askpass, err)
+	}
+
+	return []string{
+		fmt.Sprintf("GIT_ASKPASS=%s", askpass),
+		"GIT_TERMINAL_PROMPT=0",
+	}, nil
+}
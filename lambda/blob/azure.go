@@ -0,0 +1,91 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+
+	"github.com/Azure/azure-storage-blob-go/azblob"
+	"github.com/caarlos0/env"
+)
+
+// azureConfig holds the Azure Storage credentials read from the ENV, since
+// az:// addresses only carry the container name.
+type azureConfig struct {
+	Account string `env:"AZURE_STORAGE_ACCOUNT"`
+	Key     string `env:"AZURE_STORAGE_KEY"`
+}
+
+// azureStorage stores blobs in an Azure Blob Storage container.
+type azureStorage struct {
+	account       string
+	key           string
+	containerName string
+	container     azblob.ContainerURL
+}
+
+func newAzureStorage(u *url.URL) (*azureStorage, error) {
+	cfg := azureConfig{}
+	if err := env.Parse(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse ENV: %w", err)
+	}
+
+	cred, err := azblob.NewSharedKeyCredential(cfg.Account, cfg.Key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Azure shared key credential: %w", err)
+	}
+
+	pipeline := azblob.NewPipeline(cred, azblob.PipelineOptions{})
+	containerURL, err := url.Parse(fmt.Sprintf("https://%s.blob.core.windows.net/%s", cfg.Account, u.Host))
+	if err != nil {
+		return nil, fmt.Errorf("failed to build Azure container URL: %w", err)
+	}
+
+	return &azureStorage{
+		account:       cfg.Account,
+		key:           cfg.Key,
+		containerName: u.Host,
+		container:     azblob.NewContainerURL(*containerURL, pipeline),
+	}, nil
+}
+
+func (a *azureStorage) Upload(ctx context.Context, key string, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", key, err)
+	}
+
+	blockBlobURL := a.container.NewBlockBlobURL(key)
+	_, err = azblob.UploadBufferToBlockBlob(ctx, b, blockBlobURL, azblob.UploadToBlockBlobOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to az://%s: %w", key, a.containerName, err)
+	}
+
+	return nil
+}
+
+func (a *azureStorage) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	blockBlobURL := a.container.NewBlockBlobURL(key)
+
+	resp, err := blockBlobURL.Download(ctx, 0, azblob.CountToEnd, azblob.BlobAccessConditions{}, false, azblob.ClientProvidedKeyOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s from az://%s: %w", key, a.containerName, err)
+	}
+
+	return resp.Body(azblob.RetryReaderOptions{}), nil
+}
+
+// BackendHCL renders a `backend "azurerm"` block using the container's
+// storage account and key.
+func (a *azureStorage) BackendHCL(name string) (string, error) {
+	return fmt.Sprintf(`terraform {
+			backend "azurerm" {
+				storage_account_name = "%s"
+				container_name        = "%s"
+				key                   = "%s.tfstate"
+				access_key            = "%s"
+			}
+	}`, a.account, a.containerName, name, a.key), nil
+}
@@ -0,0 +1,42 @@
+// Package blob abstracts the object storage used for Terraform state and
+// module artifacts behind a single Storage interface, so the executor is
+// not tied to a single cloud provider.
+package blob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+// Storage uploads and downloads blobs and renders the `backend` block a
+// Terraform configuration needs to persist its state in that location.
+type Storage interface {
+	Upload(ctx context.Context, key string, r io.Reader) error
+	Download(ctx context.Context, key string) (io.ReadCloser, error)
+	BackendHCL(name string) (string, error)
+}
+
+// New selects a Storage implementation based on the scheme of addr, e.g.
+// "s3://bucket", "gs://bucket", or "az://container". sess is used for the
+// s3 backend, which reuses the Lambda's AWS session and credentials.
+func New(ctx context.Context, addr string, sess *session.Session) (Storage, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse storage address %q: %w", addr, err)
+	}
+
+	switch u.Scheme {
+	case "s3":
+		return newS3Storage(u, sess), nil
+	case "gs":
+		return newGCSStorage(ctx, u)
+	case "az":
+		return newAzureStorage(u)
+	default:
+		return nil, fmt.Errorf("unsupported storage scheme %q", u.Scheme)
+	}
+}
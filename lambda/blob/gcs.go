@@ -0,0 +1,60 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+
+	"cloud.google.com/go/storage"
+)
+
+// gcsStorage stores blobs in a Google Cloud Storage bucket.
+type gcsStorage struct {
+	bucket string
+	client *storage.Client
+}
+
+func newGCSStorage(ctx context.Context, u *url.URL) (*gcsStorage, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create GCS client: %w", err)
+	}
+
+	return &gcsStorage{bucket: u.Host, client: client}, nil
+}
+
+func (g *gcsStorage) Upload(ctx context.Context, key string, r io.Reader) error {
+	w := g.client.Bucket(g.bucket).Object(key).NewWriter(ctx)
+
+	if _, err := io.Copy(w, r); err != nil {
+		return fmt.Errorf("failed to upload %s to gs://%s: %w", key, g.bucket, err)
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("failed to close gs://%s/%s writer: %w", g.bucket, key, err)
+	}
+
+	return nil
+}
+
+func (g *gcsStorage) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	r, err := g.client.Bucket(g.bucket).Object(key).NewReader(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s from gs://%s: %w", key, g.bucket, err)
+	}
+
+	return r, nil
+}
+
+// BackendHCL renders a `backend "gcs"` block. Credentials are expected to
+// be provided out of band via GOOGLE_APPLICATION_CREDENTIALS, matching how
+// the rest of the executor's Google tooling authenticates.
+func (g *gcsStorage) BackendHCL(name string) (string, error) {
+	return fmt.Sprintf(`terraform {
+			backend "gcs" {
+				bucket = "%s"
+				prefix = "%s"
+			}
+	}`, g.bucket, name), nil
+}
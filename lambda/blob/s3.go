@@ -0,0 +1,77 @@
+package blob
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3Storage stores blobs in an S3 bucket.
+type s3Storage struct {
+	bucket string
+	sess   *session.Session
+	client *s3.S3
+}
+
+func newS3Storage(u *url.URL, sess *session.Session) *s3Storage {
+	return &s3Storage{
+		bucket: u.Host,
+		sess:   sess,
+		client: s3.New(sess),
+	}
+}
+
+func (s *s3Storage) Upload(ctx context.Context, key string, r io.Reader) error {
+	uploader := s3manager.NewUploaderWithClient(s.client)
+
+	_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   r,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to s3://%s: %w", key, s.bucket, err)
+	}
+
+	return nil
+}
+
+func (s *s3Storage) Download(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := s.client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s from s3://%s: %w", key, s.bucket, err)
+	}
+
+	return out.Body, nil
+}
+
+// BackendHCL renders a `backend "s3"` block, picking up the session's
+// current credentials so it stays valid even if they've been refreshed
+// since the Storage was created.
+func (s *s3Storage) BackendHCL(name string) (string, error) {
+	creds, err := s.sess.Config.Credentials.Get()
+	if err != nil {
+		return "", fmt.Errorf("failed to get AWS credentials: %w", err)
+	}
+
+	return fmt.Sprintf(`terraform {
+			backend "s3" {
+				bucket     = "%s"
+				key        = "%s.tfstate"
+				region     = "%s"
+				access_key = "%s"
+				secret_key = "%s"
+				token      = "%s"
+			}
+	}`, s.bucket, name, aws.StringValue(s.sess.Config.Region),
+		creds.AccessKeyID, creds.SecretAccessKey, creds.SessionToken), nil
+}